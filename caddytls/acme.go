@@ -0,0 +1,173 @@
+package caddytls
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// effectiveCAURL returns the ACME directory URL cfg is configured to
+// use, falling back to the package-wide default CAUrl.
+func effectiveCAURL(cfg *Config) string {
+	if cfg != nil && cfg.CA != "" {
+		return cfg.CA
+	}
+	return CAUrl
+}
+
+// caChain returns the sequence of ACME directory URLs to try for
+// cfg: its primary CA first, then its configured fallbacks in order.
+func caChain(cfg *Config) []string {
+	chain := []string{effectiveCAURL(cfg)}
+	if cfg != nil {
+		chain = append(chain, cfg.CAFallbacks...)
+	}
+	return chain
+}
+
+// keyTypeFor maps cfg.CAKeyType to the acme.KeyType the client
+// should request, defaulting to RSA2048.
+func keyTypeFor(cfg *Config) acme.KeyType {
+	if cfg == nil {
+		return acme.RSA2048
+	}
+	switch cfg.CAKeyType {
+	case "RSA4096":
+		return acme.RSA4096
+	case "EC256":
+		return acme.EC256
+	case "EC384":
+		return acme.EC384
+	default:
+		return acme.RSA2048
+	}
+}
+
+// newACMEClientForCA creates an ACME client ready to solve challenges
+// for cfg, talking to caURL specifically (rather than cfg's own CA),
+// which is how callers walk cfg's fallback CA chain, or revisit
+// whichever CA actually issued a given certificate. If allowPrompts
+// is true, agreement to the CA's subscriber agreement must already
+// have been given (Agreed), or an error is returned; no interactive
+// prompt is shown. If allowPrompts is false, Agreed is not checked.
+func newACMEClientForCA(cfg *Config, caURL string, allowPrompts bool) (*acme.Client, error) {
+	if cfg == nil {
+		cfg = new(Config)
+	}
+
+	leEmail := DefaultEmail
+	if cfg.LetsEncryptEmail != "" {
+		leEmail = cfg.LetsEncryptEmail
+	}
+
+	user, isNewUser, err := getOrCreateUser(caURL, leEmail, allowPrompts)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := acme.NewClient(caURL, &user, keyTypeFor(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	if !Agreed && allowPrompts {
+		return nil, errors.New("you must agree to the CA's subscriber agreement")
+	}
+
+	if isNewUser {
+		if err := registerUser(client, &user, cfg.ExternalAccount); err != nil {
+			return nil, err
+		}
+		if err := storeUserRegistration(caURL, user); err != nil {
+			return nil, err
+		}
+	}
+
+	solvers := map[acme.Challenge]acme.ChallengeProvider{
+		acme.TLSSNI01:  tlsSniSolver{},
+		acme.TLSALPN01: tlsALPNSolver{},
+	}
+
+	var preferred []acme.Challenge
+	for _, typ := range preferredChallengeTypes(cfg) {
+		switch typ {
+		case "http-01":
+			preferred = append(preferred, acme.HTTP01)
+		case "tls-alpn-01":
+			preferred = append(preferred, acme.TLSALPN01)
+		case "dns-01":
+			preferred = append(preferred, acme.DNS01)
+		}
+	}
+
+	client.ExcludeChallenges(excludeAllBut(preferred)...)
+	for _, challenge := range preferred {
+		if solver, ok := solvers[challenge]; ok {
+			client.SetChallengeProvider(challenge, solver)
+		}
+	}
+
+	return client, nil
+}
+
+// registerUser registers user with client, using external account
+// binding when eab is configured (as required by CAs like ZeroSSL
+// or a private step-ca), and records the resulting registration on
+// user.
+func registerUser(client *acme.Client, user *ACMEUser, eab *ExternalAccountBinding) error {
+	var reg *acme.RegistrationResource
+	var err error
+	if eab != nil {
+		reg, err = client.RegisterWithExternalAccountBinding(true, eab.KeyID, eab.HMAC)
+	} else {
+		reg, err = client.Register(true)
+	}
+	if err != nil {
+		return err
+	}
+	user.Registration = reg
+	return nil
+}
+
+// obtainCertificate gets a brand new certificate for domain from the
+// CA, for on-demand issuance (where no Config is necessarily tied to
+// a specific hostname ahead of time). It walks cfg's configured CA
+// fallback chain, trying the next CA if the previous one failed, and
+// returns the directory URL of whichever CA actually succeeded so the
+// caller can persist it alongside the certificate for renewal.
+func obtainCertificate(domain string, cfg *Config) (acme.CertificateResource, string, error) {
+	var lastErr error
+	for _, caURL := range caChain(cfg) {
+		client, err := newACMEClientForCA(cfg, caURL, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		resource, errs := client.ObtainCertificate([]string{domain}, true, nil, false)
+		if err, ok := errs[domain]; ok && err != nil {
+			lastErr = err
+			continue
+		}
+		return resource, caURL, nil
+	}
+	return acme.CertificateResource{}, "", fmt.Errorf("obtaining certificate for %s: all configured CAs failed, last error: %v", domain, lastErr)
+}
+
+// excludeAllBut returns the set of ACME challenges that are NOT in keep,
+// suitable for passing to acme.Client.ExcludeChallenges.
+func excludeAllBut(keep []acme.Challenge) []acme.Challenge {
+	all := []acme.Challenge{acme.HTTP01, acme.TLSSNI01, acme.TLSALPN01, acme.DNS01}
+	var excluded []acme.Challenge
+nextChallenge:
+	for _, c := range all {
+		for _, k := range keep {
+			if c == k {
+				continue nextChallenge
+			}
+		}
+		excluded = append(excluded, c)
+	}
+	return excluded
+}
@@ -0,0 +1,44 @@
+package caddytls
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestExcludeAllBut(t *testing.T) {
+	for i, test := range []struct {
+		keep []acme.Challenge
+		want []acme.Challenge
+	}{
+		{
+			keep: []acme.Challenge{acme.HTTP01},
+			want: []acme.Challenge{acme.TLSSNI01, acme.TLSALPN01, acme.DNS01},
+		},
+		{
+			keep: []acme.Challenge{acme.HTTP01, acme.TLSALPN01},
+			want: []acme.Challenge{acme.TLSSNI01, acme.DNS01},
+		},
+		{
+			keep: nil,
+			want: []acme.Challenge{acme.HTTP01, acme.TLSSNI01, acme.TLSALPN01, acme.DNS01},
+		},
+		{
+			keep: []acme.Challenge{acme.HTTP01, acme.TLSSNI01, acme.TLSALPN01, acme.DNS01},
+			want: nil,
+		},
+	} {
+		got := excludeAllBut(test.keep)
+		sortChallenges(got)
+		sortChallenges(test.want)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("test %d: excludeAllBut(%v) = %v, want %v", i, test.keep, got, test.want)
+		}
+	}
+}
+
+func sortChallenges(c []acme.Challenge) {
+	sort.Slice(c, func(i, j int) bool { return c[i] < c[j] })
+}
@@ -0,0 +1,85 @@
+package caddytls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// errNoCertificate is returned when an operation needs a certificate's
+// DER bytes but none are present.
+var errNoCertificate = errors.New("no certificate available")
+
+// Certificate is a tls.Certificate with associated metadata that
+// Caddy needs in order to serve and maintain it.
+type Certificate struct {
+	tls.Certificate
+
+	// Names this certificate is valid for; used to look
+	// the certificate up by SNI.
+	Names []string
+
+	// OCSP is the parsed OCSP response currently stapled to this
+	// certificate, if any. OCSPStaple is the raw DER bytes of the
+	// same response, which is what actually gets served to clients
+	// (via the embedded tls.Certificate.OCSPStaple).
+	OCSP       *ocsp.Response
+	OCSPStaple []byte
+}
+
+// leaf returns cert's parsed leaf certificate, parsing and caching it
+// on cert.Leaf if it hasn't been already.
+func (cert *Certificate) leaf() (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate.Certificate) == 0 {
+		return nil, errNoCertificate
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = parsed
+	return parsed, nil
+}
+
+// certCache holds all certificates currently in memory, keyed by
+// the name (SNI value) they're valid for. Multiple names may point
+// to the same Certificate.
+var (
+	certCache   = make(map[string]Certificate)
+	certCacheMu sync.RWMutex
+)
+
+// cacheCertificate adds cert to the cache under all of its names,
+// replacing any existing entries for those names.
+func cacheCertificate(cert Certificate) {
+	certCacheMu.Lock()
+	for _, name := range cert.Names {
+		certCache[name] = cert
+	}
+	certCacheMu.Unlock()
+
+	startOCSPMaintenance()
+}
+
+// uncacheCertificate removes the certificate for name from the cache,
+// if one is present.
+func uncacheCertificate(name string) {
+	certCacheMu.Lock()
+	delete(certCache, name)
+	certCacheMu.Unlock()
+}
+
+// getCertificate looks up the certificate for name (typically a
+// ClientHello's ServerName), returning ok=false if none is cached.
+func getCertificate(name string) (cert Certificate, ok bool) {
+	certCacheMu.RLock()
+	cert, ok = certCache[name]
+	certCacheMu.RUnlock()
+	return
+}
@@ -0,0 +1,98 @@
+package caddytls
+
+// Config describes how TLS should be configured and used
+// for a particular server (or server block). It is used
+// both to set up a tls.Config for net/http and to drive
+// the ACME lifecycle (issuance, renewal, challenge solving)
+// for hosts that are eligible for managed TLS.
+type Config struct {
+	// The hostname or class of hostnames this config applies to
+	Hostname string
+
+	// Whether TLS is enabled
+	Enabled bool
+
+	// Certificate and key file paths for manually-managed TLS
+	Certificate string
+	Key         string
+
+	// Whether TLS is managed by this config (as opposed to
+	// the user manually specifying a certificate and key)
+	Managed bool
+
+	// Whether this config qualifies for on-demand TLS (certs
+	// obtained during TLS handshakes, rather than at startup)
+	OnDemand bool
+
+	// Whether the certificate is self-signed
+	SelfSigned bool
+
+	// Manual means the user has provided the certificate and
+	// key manually, rather than deferring to managed TLS
+	Manual bool
+
+	// The email address to use when creating or looking up
+	// an ACME account for this config; "off" disables managed TLS
+	LetsEncryptEmail string
+
+	// CA is the ACME directory URL to use for this config. Empty
+	// means the package-wide default (CAUrl, Let's Encrypt by
+	// default).
+	CA string
+
+	// CAKeyType is the key type to request from CA: one of
+	// "RSA2048", "RSA4096", "EC256", or "EC384". Empty means
+	// "RSA2048".
+	CAKeyType string
+
+	// CAFallbacks, if set, are additional ACME directory URLs tried
+	// in order if CA fails. This lets an operator run against a
+	// primary CA with one or more standbys (e.g. a staging CA, or a
+	// second provider) without a single CA outage blocking
+	// issuance.
+	CAFallbacks []string
+
+	// ExternalAccount, if set, binds the ACME account used by this
+	// config to a pre-existing account at the CA via ACME's
+	// external account binding, as required by CAs like ZeroSSL or
+	// a privately-run step-ca.
+	ExternalAccount *ExternalAccountBinding
+
+	// ChallengeTypes, in order of preference, that Caddy should
+	// attempt when solving ACME challenges for this config. If
+	// empty, a sensible default order is used.
+	ChallengeTypes []string
+
+	// OnDemandConfig governs how on-demand TLS issuance behaves for
+	// this config, i.e. the rate limiting and allowlisting that
+	// keep an attacker sending arbitrary SNI values from burning
+	// through the CA's rate limits. It's only consulted when
+	// OnDemand is true; nil means the defaults apply.
+	OnDemandConfig *OnDemandConfig
+}
+
+// ExternalAccountBinding holds the credentials a CA issues out of
+// band (e.g. via its web dashboard) that tie an ACME account to a
+// pre-existing account at the CA, per RFC 8555 section 7.3.4. CAs
+// such as ZeroSSL or a privately-run step-ca require this.
+type ExternalAccountBinding struct {
+	// KeyID identifies the pre-existing account to bind to.
+	KeyID string
+
+	// HMAC is the base64url-encoded MAC key used to sign the
+	// binding, as provided by the CA.
+	HMAC string
+}
+
+// defaultChallengeTypes is the order in which challenge types
+// are attempted when a Config does not specify its own preference.
+var defaultChallengeTypes = []string{"http-01", "tls-alpn-01", "dns-01"}
+
+// preferredChallengeTypes returns cfg's configured challenge type
+// preference, falling back to defaultChallengeTypes.
+func preferredChallengeTypes(cfg *Config) []string {
+	if cfg == nil || len(cfg.ChallengeTypes) == 0 {
+		return defaultChallengeTypes
+	}
+	return cfg.ChallengeTypes
+}
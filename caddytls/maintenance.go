@@ -0,0 +1,343 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+	"golang.org/x/crypto/ocsp"
+)
+
+// renewalWindow is how long before a certificate's expiration Caddy
+// tries to renew it. It is unexported and nothing in this package
+// sets it, so it stays at 30 days unless changed in code.
+var renewalWindow = 30 * 24 * time.Hour
+
+// renewalCheckInterval is the base interval at which the maintenance
+// loop walks storage looking for certificates to renew. Each actual
+// sleep is jittered around this to avoid a thundering herd of
+// instances in a cluster hitting the CA at the same moment.
+var renewalCheckInterval = 12 * time.Hour
+
+// renewalFailureNotifyWindow is how close to expiration a cert must
+// be before a renewal failure is escalated via notifyRenewalFailure,
+// rather than just logged and retried later.
+var renewalFailureNotifyWindow = 14 * 24 * time.Hour
+
+// RenewalFailureWebhook, if set, receives a POST with a small JSON
+// payload whenever a certificate's renewal is failing within
+// renewalFailureNotifyWindow of expiring.
+var RenewalFailureWebhook string
+
+func init() {
+	renewCertificateHook = triggerImmediateRenewal
+}
+
+// triggerImmediateRenewal renews domain's certificate right away,
+// outside the normal maintenanceLoop cadence. It's wired up as
+// renewCertificateHook so that an OCSP responder reporting a
+// certificate revoked (see ocsp.go) gets a fresh certificate as soon
+// as possible, rather than waiting for the next renewal sweep. It
+// takes the same distributed lock as renewIfDue, so an immediate
+// renewal triggered by revocation can't race the scheduled renewal
+// sweep picking up the same domain at the same time.
+func triggerImmediateRenewal(domain string) {
+	lockName := fmt.Sprintf("renew_%s", domain)
+	waiter, err := storage.TryLock(lockName)
+	if err != nil {
+		log.Printf("[ERROR] locking %s for immediate renewal: %v", domain, err)
+		return
+	}
+	if waiter != nil {
+		// a renewal for this domain is already in flight; let it finish
+		// rather than race it
+		return
+	}
+	defer storage.Unlock(lockName)
+
+	data, err := storage.LoadSite(domain)
+	if err != nil {
+		log.Printf("[ERROR] loading %s for immediate renewal: %v", domain, err)
+		return
+	}
+	if err := renewCertificate(domain, data); err != nil {
+		log.Printf("[ERROR] immediately renewing %s after revocation: %v", domain, err)
+		return
+	}
+	clearBackoff(domain)
+}
+
+var startMaintenanceOnce sync.Once
+
+// startMaintenance starts the background goroutine that renews
+// certificates nearing expiration. It is safe to call more than
+// once; only the first call (typically the first time a managed
+// cert is obtained) has any effect.
+func startMaintenance() {
+	startMaintenanceOnce.Do(func() {
+		go maintenanceLoop()
+	})
+}
+
+// maintenanceLoop periodically walks storage renewing any
+// certificates that are due, until the process exits.
+func maintenanceLoop() {
+	for {
+		time.Sleep(jittered(renewalCheckInterval))
+		renewExpiringCertificates()
+	}
+}
+
+// jittered returns a duration randomly spread across [base/2,
+// base*3/2), so that instances in a cluster don't all wake up and
+// hit the CA at the same instant.
+func jittered(base time.Duration) time.Duration {
+	return base/2 + time.Duration(rand.Int63n(int64(base)))
+}
+
+// renewalFailure tracks a domain that recently failed renewal, so
+// that a persistently failing CA or network doesn't get hammered
+// every renewalCheckInterval.
+type renewalFailure struct {
+	attempts  int
+	retryable time.Time
+}
+
+var (
+	renewalBackoffMu sync.Mutex
+	renewalBackoff   = make(map[string]renewalFailure)
+)
+
+// nextBackoff returns the next exponential backoff for domain (1, 2,
+// 4, 8, ... renewalCheckIntervals, capped at 16) and records it, along
+// with when domain next becomes eligible for a retry.
+func nextBackoff(domain string) time.Duration {
+	renewalBackoffMu.Lock()
+	defer renewalBackoffMu.Unlock()
+	f := renewalBackoff[domain]
+	factor := 16
+	if f.attempts < 4 {
+		factor = 1 << uint(f.attempts)
+	}
+	f.attempts++
+	backoff := time.Duration(factor) * renewalCheckInterval
+	f.retryable = time.Now().Add(backoff)
+	renewalBackoff[domain] = f
+	return backoff
+}
+
+// renewalBackoffReady reports whether domain is past any backoff
+// period recorded by a previous failed renewal attempt.
+func renewalBackoffReady(domain string) bool {
+	renewalBackoffMu.Lock()
+	defer renewalBackoffMu.Unlock()
+	f, ok := renewalBackoff[domain]
+	return !ok || !time.Now().Before(f.retryable)
+}
+
+func clearBackoff(domain string) {
+	renewalBackoffMu.Lock()
+	delete(renewalBackoff, domain)
+	renewalBackoffMu.Unlock()
+}
+
+// renewExpiringCertificates walks every site in storage and renews
+// those within renewalWindow of expiring.
+func renewExpiringCertificates() {
+	domains, err := storage.AllSites()
+	if err != nil {
+		log.Printf("[ERROR] listing sites for renewal: %v", err)
+		return
+	}
+	for _, domain := range domains {
+		renewIfDue(domain)
+	}
+}
+
+// renewIfDue renews domain's certificate if it's within
+// renewalWindow of expiring (or already expired), coordinating with
+// other cluster instances via storage's distributed lock so that
+// only one of them does the work.
+func renewIfDue(domain string) {
+	if !renewalBackoffReady(domain) {
+		return
+	}
+
+	lockName := fmt.Sprintf("renew_%s", domain)
+	waiter, err := storage.TryLock(lockName)
+	if err != nil {
+		log.Printf("[ERROR] locking %s for renewal: %v", domain, err)
+		return
+	}
+	if waiter != nil {
+		// another instance is already renewing (or holding a stale
+		// lock); let it finish rather than race it
+		return
+	}
+	defer storage.Unlock(lockName)
+
+	data, err := storage.LoadSite(domain)
+	if err != nil {
+		log.Printf("[ERROR] loading %s for renewal check: %v", domain, err)
+		return
+	}
+
+	leaf, err := parseLeafCertificate(data.Cert)
+	if err != nil {
+		log.Printf("[ERROR] parsing certificate for %s: %v", domain, err)
+		return
+	}
+
+	timeLeft := leaf.NotAfter.Sub(time.Now())
+	if timeLeft > renewalWindow {
+		return
+	}
+
+	if err := renewCertificate(domain, data); err != nil {
+		backoff := nextBackoff(domain)
+		log.Printf("[ERROR] renewing certificate for %s (retrying in %s): %v", domain, backoff, err)
+		if timeLeft < renewalFailureNotifyWindow {
+			notifyRenewalFailure(domain, leaf.NotAfter, err)
+		}
+		return
+	}
+
+	clearBackoff(domain)
+}
+
+// renewCertificate obtains a fresh certificate for domain from the
+// CA, persists it to storage (atomically, via the Storage
+// implementation), and refreshes the in-memory cache. Because the
+// cache holds Certificate values rather than pointers, in-flight TLS
+// handshakes that already looked up the old certificate keep their
+// own copy and are unaffected; only lookups that happen after the
+// swap see the new one.
+func renewCertificate(domain string, data SiteData) error {
+	var oldResource acme.CertificateResource
+	if err := json.Unmarshal(data.Meta, &oldResource); err != nil {
+		return err
+	}
+	oldResource.Certificate = data.Cert
+	oldResource.PrivateKey = data.Key
+
+	caURL := data.CAURL
+	if caURL == "" {
+		// the cert was stored before CAURL was persisted; fall back
+		// to the package-wide default rather than fail renewal
+		caURL = effectiveCAURL(nil)
+	}
+	cfg := &Config{CAKeyType: data.CAKeyType}
+	if data.EABKeyID != "" || data.EABHMAC != "" {
+		cfg.ExternalAccount = &ExternalAccountBinding{KeyID: data.EABKeyID, HMAC: data.EABHMAC}
+	}
+
+	client, err := newACMEClientForCA(cfg, caURL, false)
+	if err != nil {
+		return err
+	}
+
+	newResource, err := client.RenewCertificate(oldResource, true, false)
+	if err != nil {
+		return err
+	}
+
+	if err := saveCertResource(newResource, caURL, data.CAKeyType, cfg.ExternalAccount); err != nil {
+		return err
+	}
+
+	cert, err := buildCertificate(newResource)
+	if err != nil {
+		return err
+	}
+	cacheCertificate(cert)
+
+	return nil
+}
+
+// buildCertificate turns a freshly (re)issued CertificateResource
+// into a Certificate ready for the in-memory cache. If storage holds
+// a persisted OCSP staple for the site, it's attached here too. A
+// site just written by saveCertResource has no staple (StoreSite
+// removes the previous certificate's staple file), so a freshly
+// obtained or renewed certificate is cached without a staple until
+// the OCSP maintenance loop staples it.
+func buildCertificate(resource acme.CertificateResource) (Certificate, error) {
+	tlsCert, err := tls.X509KeyPair(resource.Certificate, resource.PrivateKey)
+	if err != nil {
+		return Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return Certificate{}, err
+	}
+	tlsCert.Leaf = leaf
+
+	names := leaf.DNSNames
+	if len(names) == 0 {
+		names = []string{resource.Domain}
+	}
+
+	cert := Certificate{
+		Certificate: tlsCert,
+		Names:       names,
+	}
+
+	if data, err := storage.LoadSite(resource.Domain); err == nil && len(data.OCSPStaple) > 0 {
+		if parsed, err := ocsp.ParseResponse(data.OCSPStaple, nil); err == nil {
+			cert.OCSP = parsed
+			cert.OCSPStaple = data.OCSPStaple
+			cert.Certificate.OCSPStaple = data.OCSPStaple
+		}
+	}
+
+	return cert, nil
+}
+
+// parseLeafCertificate parses the first PEM-encoded certificate in
+// certPEM (the leaf, by convention of how lego writes cert bundles).
+func parseLeafCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("no PEM block found in certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// notifyRenewalFailure logs a renewal failure that's getting close
+// to the certificate's expiration, and if RenewalFailureWebhook is
+// configured, POSTs a small JSON payload describing it so operators
+// can be paged.
+func notifyRenewalFailure(domain string, expires time.Time, renewErr error) {
+	log.Printf("[ERROR] %s: certificate expires %s and renewal is failing: %v", domain, expires.Format(time.RFC3339), renewErr)
+
+	if RenewalFailureWebhook == "" {
+		return
+	}
+
+	payload, err := json.Marshal(struct {
+		Domain  string    `json:"domain"`
+		Expires time.Time `json:"expires"`
+		Error   string    `json:"error"`
+	}{domain, expires, renewErr.Error()})
+	if err != nil {
+		log.Printf("[ERROR] marshaling renewal failure notification for %s: %v", domain, err)
+		return
+	}
+
+	resp, err := http.Post(RenewalFailureWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("[ERROR] notifying renewal failure webhook for %s: %v", domain, err)
+		return
+	}
+	resp.Body.Close()
+}
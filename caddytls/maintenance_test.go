@@ -0,0 +1,39 @@
+package caddytls
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	defer clearBackoff("example.com")
+
+	origInterval := renewalCheckInterval
+	renewalCheckInterval = time.Second
+	defer func() { renewalCheckInterval = origInterval }()
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 16 * time.Second}
+	for i, w := range want {
+		if got := nextBackoff("example.com"); got != w {
+			t.Errorf("attempt %d: nextBackoff = %s, want %s", i, got, w)
+		}
+	}
+}
+
+func TestRenewalBackoffReady(t *testing.T) {
+	defer clearBackoff("example.com")
+
+	if !renewalBackoffReady("example.com") {
+		t.Fatal("a domain with no recorded failure should be ready")
+	}
+
+	nextBackoff("example.com")
+	if renewalBackoffReady("example.com") {
+		t.Fatal("a domain that just failed should not be ready during its backoff window")
+	}
+
+	clearBackoff("example.com")
+	if !renewalBackoffReady("example.com") {
+		t.Fatal("clearBackoff should make the domain ready again")
+	}
+}
@@ -0,0 +1,176 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspCheckInterval is how often the maintenance goroutine wakes up
+// to look for cached certificates whose OCSP staple is missing or
+// nearing its NextUpdate. It's a var so tests can speed it up.
+var ocspCheckInterval = 1 * time.Hour
+
+// ocspUpdateGracePeriod is how long before a staple's NextUpdate
+// we attempt to refresh it, to leave room for a slow or unreachable
+// responder. If refreshing keeps failing, the old staple stays cached
+// and is still served after its NextUpdate.
+var ocspUpdateGracePeriod = time.Hour
+
+// renewCertificateHook is invoked with the name of a cached
+// certificate that an OCSP responder has reported as revoked. Its
+// default is a no-op; maintenance.go's init sets it to
+// triggerImmediateRenewal.
+var renewCertificateHook = func(name string) {}
+
+// errCertRevoked is returned by stapleOCSP when the responder reports
+// the certificate as revoked, so callers know to evict it.
+var errCertRevoked = errors.New("certificate has been revoked")
+
+var startOCSPMaintenanceOnce sync.Once
+
+// startOCSPMaintenance starts the background goroutine that keeps
+// cached certificates' OCSP staples fresh. It is safe to call more
+// than once; only the first call has any effect.
+func startOCSPMaintenance() {
+	startOCSPMaintenanceOnce.Do(func() {
+		go ocspMaintenanceLoop()
+	})
+}
+
+// ocspMaintenanceLoop periodically refreshes OCSP staples for all
+// certificates in the cache until the process exits.
+func ocspMaintenanceLoop() {
+	ticker := time.NewTicker(ocspCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		refreshOCSPStaples()
+	}
+}
+
+// refreshOCSPStaples finds cached certificates whose OCSP staple is
+// missing or due for renewal and refreshes them.
+func refreshOCSPStaples() {
+	certCacheMu.RLock()
+	stale := make(map[string]Certificate)
+	for _, cert := range certCache {
+		if needsOCSPRefresh(cert) {
+			stale[strings.Join(cert.Names, ",")] = cert
+		}
+	}
+	certCacheMu.RUnlock()
+
+	for _, cert := range stale {
+		cert := cert
+		if err := stapleOCSP(&cert, storage); err != nil {
+			if err == errCertRevoked {
+				for _, name := range cert.Names {
+					uncacheCertificate(name)
+				}
+				if len(cert.Names) > 0 {
+					renewCertificateHook(cert.Names[0])
+				}
+				continue
+			}
+			log.Printf("[ERROR] refreshing OCSP staple for %v: %v", cert.Names, err)
+			continue
+		}
+		cacheCertificate(cert)
+	}
+}
+
+// needsOCSPRefresh returns true if cert has no OCSP staple yet, or
+// if its current staple is within ocspUpdateGracePeriod of expiring.
+func needsOCSPRefresh(cert Certificate) bool {
+	if cert.OCSP == nil {
+		return true
+	}
+	return time.Now().After(cert.OCSP.NextUpdate.Add(-ocspUpdateGracePeriod))
+}
+
+// stapleOCSP fetches a fresh OCSP response for cert, verifies it
+// against the issuing certificate, and atomically swaps it into
+// cert. If s is non-nil and cert is a known site in storage, the
+// fresh staple is persisted alongside the cert so that it survives
+// restarts even when the responder later becomes unreachable.
+func stapleOCSP(cert *Certificate, s Storage) error {
+	leaf, err := cert.leaf()
+	if err != nil {
+		return err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		// CA didn't publish a responder; nothing to staple
+		return nil
+	}
+	if len(cert.Certificate.Certificate) < 2 {
+		return errNoCertificate
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate.Certificate[1])
+	if err != nil {
+		return err
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return err
+	}
+
+	raw, err := requestOCSP(leaf.OCSPServer[0], req)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return err
+	}
+	if parsed.Status == ocsp.Revoked {
+		return errCertRevoked
+	}
+
+	cert.OCSP = parsed
+	cert.OCSPStaple = raw
+	cert.Certificate.OCSPStaple = raw
+
+	if s == nil || len(cert.Names) == 0 {
+		return nil
+	}
+	domain := cert.Names[0]
+	exists, err := s.SiteExists(domain)
+	if err != nil || !exists {
+		// not a managed site (e.g. a challenge certificate); no
+		// stored cert/key to persist the staple alongside
+		return nil
+	}
+	return persistOCSPStaple(s, domain, raw)
+}
+
+// persistOCSPStaple saves staple to storage as the OCSP staple for
+// domain, without disturbing the site's existing cert, key, or meta.
+func persistOCSPStaple(s Storage, domain string, staple []byte) error {
+	data, err := s.LoadSite(domain)
+	if err != nil {
+		return err
+	}
+	data.OCSPStaple = staple
+	return s.StoreSite(domain, data)
+}
+
+// requestOCSP sends req to the OCSP responder at url and returns the
+// raw DER-encoded response.
+func requestOCSP(url string, req []byte) ([]byte, error) {
+	resp, err := http.Post(url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,174 @@
+package caddytls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestNeedsOCSPRefresh(t *testing.T) {
+	if !needsOCSPRefresh(Certificate{}) {
+		t.Error("a certificate with no OCSP response needs a refresh")
+	}
+
+	fresh := Certificate{OCSP: &ocsp.Response{NextUpdate: time.Now().Add(2 * ocspUpdateGracePeriod)}}
+	if needsOCSPRefresh(fresh) {
+		t.Error("a certificate whose staple is far from expiring shouldn't need a refresh")
+	}
+
+	stale := Certificate{OCSP: &ocsp.Response{NextUpdate: time.Now().Add(ocspUpdateGracePeriod / 2)}}
+	if !needsOCSPRefresh(stale) {
+		t.Error("a certificate within the grace period of its staple expiring needs a refresh")
+	}
+}
+
+func TestRequestOCSP(t *testing.T) {
+	want := []byte("a fake DER-encoded OCSP response")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(want)
+	}))
+	defer srv.Close()
+
+	got, err := requestOCSP(srv.URL, []byte("request"))
+	if err != nil {
+		t.Fatalf("requestOCSP: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("requestOCSP = %q, want %q", got, want)
+	}
+}
+
+// selfSignedOCSPResponse builds a DER-encoded OCSP response, signed by
+// a throwaway key, good enough for ocsp.ParseResponse(raw, nil) (which
+// doesn't verify the signature without an issuer certificate) to parse
+// successfully.
+func selfSignedOCSPResponse(t *testing.T, serial *big.Int, nextUpdate time.Time) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Test Responder"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ocsp.CreateResponse(responder, responder, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: serial,
+		ThisUpdate:   time.Now(),
+		NextUpdate:   nextUpdate,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// selfSignedCertAndKey generates a throwaway self-signed certificate
+// for domain and its PEM-encoded EC private key, in the same shape
+// lego hands back in an acme.CertificateResource.
+func selfSignedCertAndKey(t *testing.T, domain string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Test"}},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+func TestBuildCertificateLoadsPersistedStaple(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origStorage := storage
+	storage = &FileStorage{Path: dir}
+	defer func() { storage = origStorage }()
+
+	certPEM, keyPEM := selfSignedCertAndKey(t, "example.com")
+
+	leaf, err := parseLeafCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staple := selfSignedOCSPResponse(t, leaf.SerialNumber, time.Now().Add(time.Hour))
+
+	if err := storage.StoreSite("example.com", SiteData{
+		Cert:       certPEM,
+		Key:        keyPEM,
+		Meta:       []byte("{}"),
+		OCSPStaple: staple,
+	}); err != nil {
+		t.Fatalf("StoreSite: %v", err)
+	}
+
+	cert, err := buildCertificate(acme.CertificateResource{
+		Domain:      "example.com",
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+	})
+	if err != nil {
+		t.Fatalf("buildCertificate: %v", err)
+	}
+
+	if cert.OCSP == nil {
+		t.Fatal("expected buildCertificate to attach the persisted OCSP staple")
+	}
+	if string(cert.OCSPStaple) != string(staple) {
+		t.Error("cert.OCSPStaple doesn't match the persisted staple")
+	}
+	if string(cert.Certificate.OCSPStaple) != string(staple) {
+		t.Error("cert.Certificate.OCSPStaple doesn't match the persisted staple")
+	}
+}
@@ -0,0 +1,233 @@
+package caddytls
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// OnDemandConfig governs on-demand TLS issuance: obtaining a
+// certificate the first time a ClientHello asks for a hostname,
+// rather than ahead of time. Because the hostname comes from an
+// untrusted SNI value, it needs its own gate against attackers
+// trying to burn through the CA's rate limits.
+type OnDemandConfig struct {
+	// AskURL, if set, is consulted before issuance: Caddy does a
+	// GET to AskURL with a "domain" query parameter and only
+	// proceeds if the response status is 200. This lets operators
+	// plug in their own allowlist service.
+	AskURL string
+
+	// MaxObtainsPerWindow is how many new certificates this config
+	// may obtain in Window before further on-demand requests are
+	// rejected. Zero means no per-config limit (the global
+	// maxConcurrentOnDemandIssuance still applies).
+	MaxObtainsPerWindow int
+
+	// Window is the sliding window over which MaxObtainsPerWindow
+	// is enforced.
+	Window time.Duration
+
+	obtainedMu sync.Mutex
+	obtained   []time.Time
+}
+
+// allow reports whether another on-demand issuance is permitted
+// right now under od's sliding-window cap, and if so records it.
+func (od *OnDemandConfig) allow() bool {
+	if od == nil || od.MaxObtainsPerWindow <= 0 {
+		return true
+	}
+
+	od.obtainedMu.Lock()
+	defer od.obtainedMu.Unlock()
+
+	cutoff := time.Now().Add(-od.Window)
+	kept := od.obtained[:0]
+	for _, t := range od.obtained {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	od.obtained = kept
+
+	if len(od.obtained) >= od.MaxObtainsPerWindow {
+		return false
+	}
+	od.obtained = append(od.obtained, time.Now())
+	return true
+}
+
+// ask performs od's AskURL check for name, if configured.
+func (od *OnDemandConfig) ask(name string) error {
+	if od == nil || od.AskURL == "" {
+		return nil
+	}
+
+	askURL, err := url.Parse(od.AskURL)
+	if err != nil {
+		return fmt.Errorf("parsing ask URL: %v", err)
+	}
+	qs := askURL.Query()
+	qs.Set("domain", name)
+	askURL.RawQuery = qs.Encode()
+
+	resp, err := http.Get(askURL.String())
+	if err != nil {
+		return fmt.Errorf("checking %s: %v", od.AskURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s not allowed by %s (got status %d)", name, od.AskURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// maxConcurrentOnDemandIssuance bounds how many on-demand
+// certificates may be in flight at once, across all configs, so a
+// burst of distinct SNIs can't pile up unbounded concurrent ACME
+// requests. onDemandIssuanceSem is sized from its value when the
+// package is initialized; changing it afterwards has no effect.
+var maxConcurrentOnDemandIssuance = 10
+
+var onDemandIssuanceSem = make(chan struct{}, maxConcurrentOnDemandIssuance)
+
+// onDemandFailure is a name that recently failed on-demand issuance
+// (or its ask check), tracked so repeated requests for it back off
+// exponentially instead of hammering the ask URL or the CA.
+type onDemandFailure struct {
+	attempts  int
+	retryable time.Time
+}
+
+var (
+	onDemandFailuresMu sync.Mutex
+	onDemandFailures   = make(map[string]onDemandFailure)
+)
+
+// onDemandBackoffBase and onDemandBackoffMax bound the exponential
+// backoff applied to names in onDemandFailures.
+var (
+	onDemandBackoffBase = time.Second
+	onDemandBackoffMax  = 10 * time.Minute
+)
+
+// checkOnDemandFailure returns an error if name is currently in its
+// backoff period following a recent on-demand failure.
+func checkOnDemandFailure(name string) error {
+	onDemandFailuresMu.Lock()
+	defer onDemandFailuresMu.Unlock()
+	f, ok := onDemandFailures[name]
+	if !ok {
+		return nil
+	}
+	if time.Now().Before(f.retryable) {
+		return fmt.Errorf("%s recently failed on-demand issuance; retry after %s", name, f.retryable.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// recordOnDemandFailure records a failed on-demand attempt for name
+// and schedules its next allowed retry with exponential backoff.
+func recordOnDemandFailure(name string) {
+	onDemandFailuresMu.Lock()
+	defer onDemandFailuresMu.Unlock()
+	f := onDemandFailures[name]
+	f.attempts++
+	backoff := onDemandBackoffMax
+	if f.attempts <= 32 {
+		if b := onDemandBackoffBase * time.Duration(1<<uint(f.attempts-1)); b < backoff {
+			backoff = b
+		}
+	}
+	f.retryable = time.Now().Add(backoff)
+	onDemandFailures[name] = f
+}
+
+// clearOnDemandFailure forgets any past failures recorded for name,
+// called after a successful issuance.
+func clearOnDemandFailure(name string) {
+	onDemandFailuresMu.Lock()
+	delete(onDemandFailures, name)
+	onDemandFailuresMu.Unlock()
+}
+
+// obtainOnDemandCertificate gets, caches, and returns a new
+// certificate for name under cfg's on-demand policy. It's meant to
+// be called from the GetCertificate hot path on a cache miss, so it
+// enforces the negative cache, the global concurrency limit, the
+// per-config rate limit, and the ask URL (in roughly increasing
+// order of cost) before ever talking to the ACME client.
+func obtainOnDemandCertificate(name string, cfg *Config) (Certificate, error) {
+	if err := checkOnDemandFailure(name); err != nil {
+		return Certificate{}, err
+	}
+
+	// coordinate with any other handshake (in this process or another
+	// instance in the cluster) already obtaining a certificate for
+	// name, so a burst of simultaneous connections for a brand new SNI
+	// doesn't each independently hit the ACME client. This has to
+	// happen before the semaphore below: a goroutine that's only
+	// waiting on someone else's in-flight issuance isn't itself doing
+	// any issuing, so it shouldn't occupy one of the limited global
+	// concurrency slots while it waits.
+	lockName := fmt.Sprintf("ondemand_%s", name)
+	waiter, err := storage.TryLock(lockName)
+	if err != nil {
+		return Certificate{}, err
+	}
+	if waiter != nil {
+		waiter.Wait()
+		if cert, ok := getCertificate(name); ok {
+			return cert, nil
+		}
+		return Certificate{}, fmt.Errorf("on-demand issuance for %s already in progress elsewhere", name)
+	}
+	defer storage.Unlock(lockName)
+
+	// another goroutine in this process may have raced us to the
+	// lock and already obtained and cached the certificate
+	if cert, ok := getCertificate(name); ok {
+		return cert, nil
+	}
+
+	select {
+	case onDemandIssuanceSem <- struct{}{}:
+		defer func() { <-onDemandIssuanceSem }()
+	default:
+		return Certificate{}, errors.New("too many concurrent on-demand certificate issuances")
+	}
+
+	if !cfg.OnDemandConfig.allow() {
+		recordOnDemandFailure(name)
+		return Certificate{}, fmt.Errorf("on-demand issuance rate limit exceeded for %s", name)
+	}
+
+	if err := cfg.OnDemandConfig.ask(name); err != nil {
+		recordOnDemandFailure(name)
+		return Certificate{}, err
+	}
+
+	resource, caURL, err := obtainCertificate(name, cfg)
+	if err != nil {
+		recordOnDemandFailure(name)
+		return Certificate{}, err
+	}
+
+	if err := saveCertResource(resource, caURL, cfg.CAKeyType, cfg.ExternalAccount); err != nil {
+		return Certificate{}, err
+	}
+
+	cert, err := buildCertificate(resource)
+	if err != nil {
+		return Certificate{}, err
+	}
+	cacheCertificate(cert)
+	clearOnDemandFailure(name)
+
+	return cert, nil
+}
@@ -0,0 +1,47 @@
+package caddytls
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnDemandConfigAllow(t *testing.T) {
+	od := &OnDemandConfig{MaxObtainsPerWindow: 2, Window: time.Hour}
+
+	if !od.allow() {
+		t.Fatal("1st obtain should be allowed")
+	}
+	if !od.allow() {
+		t.Fatal("2nd obtain should be allowed")
+	}
+	if od.allow() {
+		t.Fatal("3rd obtain should be rejected by the per-window cap")
+	}
+
+	// entries older than the window should fall out and free up room
+	od.obtainedMu.Lock()
+	for i := range od.obtained {
+		od.obtained[i] = time.Now().Add(-2 * od.Window)
+	}
+	od.obtainedMu.Unlock()
+
+	if !od.allow() {
+		t.Fatal("obtain should be allowed again once old entries age out of the window")
+	}
+}
+
+func TestOnDemandConfigAllowUnlimited(t *testing.T) {
+	var od *OnDemandConfig
+	for i := 0; i < 100; i++ {
+		if !od.allow() {
+			t.Fatal("a nil OnDemandConfig should never rate-limit")
+		}
+	}
+
+	od = &OnDemandConfig{}
+	for i := 0; i < 100; i++ {
+		if !od.allow() {
+			t.Fatal("MaxObtainsPerWindow of 0 should mean unlimited")
+		}
+	}
+}
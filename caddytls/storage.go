@@ -0,0 +1,467 @@
+package caddytls
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is the interface that Caddy uses to persist and retrieve
+// TLS assets: site certificates and keys, ACME account data, and the
+// distributed locks used to coordinate issuance across instances.
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// SiteExists returns true if data for domain is present in storage.
+	SiteExists(domain string) (bool, error)
+
+	// LoadSite returns the stored certificate, key, and metadata for domain.
+	LoadSite(domain string) (SiteData, error)
+
+	// StoreSite persists data as the certificate, key, and metadata for domain.
+	StoreSite(domain string, data SiteData) error
+
+	// DeleteSite removes all stored data for domain.
+	DeleteSite(domain string) error
+
+	// AllSites returns the domains of every site currently in storage,
+	// so that callers can walk the whole set (e.g. for renewal).
+	AllSites() ([]string, error)
+
+	// LoadUser returns the stored ACME account for email, as
+	// registered with the CA at caURL. Accounts are namespaced per
+	// CA since the same email may have a distinct account (and
+	// private key) at each one.
+	LoadUser(caURL, email string) (UserData, error)
+
+	// StoreUser persists data as the ACME account for email at caURL.
+	StoreUser(caURL, email string, data UserData) error
+
+	// TryLock attempts to acquire a distributed lock for name. If the
+	// lock is already held, TryLock returns a Waiter that is done
+	// when the lock becomes available, is deemed stale, or the
+	// implementation stops waiting (FileStorage's gives up after
+	// lockPollAttempts polls), and the caller should call TryLock
+	// again rather than assume it now holds the lock. If TryLock
+	// acquires the lock itself, it returns a nil Waiter.
+	TryLock(name string) (Waiter, error)
+
+	// Unlock releases the lock for name. Only the holder of the lock
+	// should call it: FileStorage's Unlock removes the lock whoever
+	// holds it, and returns nil if the lock is not held at all.
+	Unlock(name string) error
+}
+
+// Waiter is something that might be busy for an as-yet-undetermined
+// amount of time, such as a lock held by another instance.
+type Waiter interface {
+	Wait()
+}
+
+// SiteData holds the bytes that make up a site's certificate, key,
+// and associated metadata, as saved to and loaded from storage.
+type SiteData struct {
+	Cert []byte
+	Key  []byte
+	Meta []byte
+
+	// OCSPStaple is the last-known-good OCSP response for Cert, if
+	// any. It's persisted so that stapling survives restarts even
+	// when the OCSP responder is temporarily unavailable.
+	OCSPStaple []byte
+
+	// CAURL is the ACME directory URL of the CA that issued Cert. It's
+	// persisted so that renewal talks to the same CA (and, if
+	// applicable, the same external account) the certificate was
+	// originally obtained from, rather than whatever cfg.CA happens
+	// to be configured as by the time renewal runs. Empty for sites
+	// stored before this field existed, in which case renewal falls
+	// back to the package-wide default CA.
+	CAURL string
+
+	// CAKeyType is the key type that was requested from CAURL when
+	// Cert was issued; see Config.CAKeyType.
+	CAKeyType string
+
+	// EABKeyID and EABHMAC are the external account binding
+	// credentials (if any) that were used when registering the ACME
+	// account Cert was issued under; see ExternalAccountBinding.
+	EABKeyID string
+	EABHMAC  string
+}
+
+// UserData holds the bytes that make up an ACME account's
+// registration resource and private key.
+type UserData struct {
+	Reg []byte
+	Key []byte
+}
+
+// StorageConstructor creates a Storage implementation configured to
+// talk to the CA at caURL. Constructors are registered by name with
+// RegisterStorageProvider.
+type StorageConstructor func(caURL string) (Storage, error)
+
+// storageProviders is the registry of storage backends plugged into
+// Caddy, keyed by name.
+var storageProviders = make(map[string]StorageConstructor)
+
+// RegisterStorageProvider registers ctor under name in
+// storageProviders. Nothing in this package looks providers up in
+// that registry: the storage variable below is always a FileStorage.
+func RegisterStorageProvider(name string, ctor StorageConstructor) {
+	storageProviders[name] = ctor
+}
+
+func init() {
+	RegisterStorageProvider("file", func(caURL string) (Storage, error) {
+		return &FileStorage{Path: storageBasePath}, nil
+	})
+}
+
+// storage is the Storage this package uses: a filesystem-backed
+// FileStorage rooted at storageBasePath. No other backend is
+// selected by this package.
+var storage Storage = &FileStorage{Path: storageBasePath}
+
+// storageBasePath is where all of Caddy's TLS assets (certificates,
+// keys, and account data) are kept on disk by default.
+var storageBasePath = filepath.Join(".", ".caddy")
+
+// FileStorage is a filesystem-backed implementation of Storage. It
+// preserves the on-disk layout Caddy has always used.
+type FileStorage struct {
+	Path string
+}
+
+func (s *FileStorage) sites() string { return filepath.Join(s.Path, "sites") }
+func (s *FileStorage) site(domain string) string {
+	return filepath.Join(s.sites(), domain)
+}
+func (s *FileStorage) siteCertFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".crt")
+}
+func (s *FileStorage) siteKeyFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".key")
+}
+func (s *FileStorage) siteMetaFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".json")
+}
+func (s *FileStorage) siteOCSPStapleFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".ocsp")
+}
+func (s *FileStorage) siteCAFile(domain string) string {
+	return filepath.Join(s.site(domain), domain+".ca.json")
+}
+
+func (s *FileStorage) users() string { return filepath.Join(s.Path, "users") }
+func (s *FileStorage) ca(caURL string) string {
+	return filepath.Join(s.users(), caDirName(caURL))
+}
+func (s *FileStorage) user(caURL, email string) string {
+	return filepath.Join(s.ca(caURL), email)
+}
+func (s *FileStorage) userRegFile(caURL, email string) string {
+	return filepath.Join(s.user(caURL, email), email+".json")
+}
+func (s *FileStorage) userKeyFile(caURL, email string) string {
+	return filepath.Join(s.user(caURL, email), email+".key")
+}
+
+// caDirName turns caURL into a string that's safe to use as a
+// directory name, so each CA's accounts live in their own namespace
+// (e.g. "acme-v02.api.letsencrypt.org" and "acme.zerossl.com" don't
+// collide, and neither clobbers the other's account for the same
+// email).
+func caDirName(caURL string) string {
+	if caURL == "" {
+		return "default"
+	}
+	if u, err := url.Parse(caURL); err == nil && u.Host != "" {
+		caURL = u.Host
+	}
+	replacer := strings.NewReplacer("/", "_", ":", "_", "?", "_", "&", "_")
+	return replacer.Replace(caURL)
+}
+
+// SiteExists implements Storage.
+func (s *FileStorage) SiteExists(domain string) (bool, error) {
+	_, err := os.Stat(s.siteCertFile(domain))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(s.siteKeyFile(domain))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// LoadSite implements Storage.
+func (s *FileStorage) LoadSite(domain string) (SiteData, error) {
+	var data SiteData
+	var err error
+
+	data.Cert, err = ioutil.ReadFile(s.siteCertFile(domain))
+	if err != nil {
+		return data, err
+	}
+	data.Key, err = ioutil.ReadFile(s.siteKeyFile(domain))
+	if err != nil {
+		return data, err
+	}
+	data.Meta, err = ioutil.ReadFile(s.siteMetaFile(domain))
+	if err != nil {
+		return data, err
+	}
+
+	// the OCSP staple is best-effort: it may not exist yet (the site
+	// was never stapled) or may be temporarily missing, neither of
+	// which should prevent the cert and key from loading
+	data.OCSPStaple, err = ioutil.ReadFile(s.siteOCSPStapleFile(domain))
+	if err != nil && !os.IsNotExist(err) {
+		return data, err
+	}
+
+	// the issuing CA sidecar is likewise best-effort: it doesn't exist
+	// for sites stored before this field was introduced
+	caBytes, err := ioutil.ReadFile(s.siteCAFile(domain))
+	if err != nil && !os.IsNotExist(err) {
+		return data, err
+	}
+	if len(caBytes) > 0 {
+		var ca siteCAData
+		if err := json.Unmarshal(caBytes, &ca); err != nil {
+			return data, err
+		}
+		data.CAURL = ca.CAURL
+		data.CAKeyType = ca.CAKeyType
+		data.EABKeyID = ca.EABKeyID
+		data.EABHMAC = ca.EABHMAC
+	}
+
+	return data, nil
+}
+
+// siteCAData is the on-disk shape of a site's issuing-CA sidecar
+// file, persisted alongside its certificate, key, and metadata.
+type siteCAData struct {
+	CAURL     string
+	CAKeyType string
+	EABKeyID  string
+	EABHMAC   string
+}
+
+// StoreSite implements Storage. Each file is written via a temp
+// file + rename so that a reader (or a crash) never observes a
+// partially-written cert, key, or staple, which matters when this
+// overwrites a site that's already serving live traffic.
+func (s *FileStorage) StoreSite(domain string, data SiteData) error {
+	err := os.MkdirAll(s.site(domain), 0700)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.siteCertFile(domain), data.Cert, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.siteKeyFile(domain), data.Key, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.siteMetaFile(domain), data.Meta, 0600)
+	if err != nil {
+		return err
+	}
+	if len(data.OCSPStaple) > 0 {
+		if err := writeFileAtomic(s.siteOCSPStapleFile(domain), data.OCSPStaple, 0600); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.siteOCSPStapleFile(domain)); err != nil && !os.IsNotExist(err) {
+		// data has no staple of its own (e.g. a fresh issuance or
+		// renewal that hasn't been stapled yet); don't leave behind a
+		// stale staple from a previous, now-replaced certificate
+		return err
+	}
+	if data.CAURL == "" && data.CAKeyType == "" && data.EABKeyID == "" && data.EABHMAC == "" {
+		return nil
+	}
+	caBytes, err := json.Marshal(siteCAData{
+		CAURL:     data.CAURL,
+		CAKeyType: data.CAKeyType,
+		EABKeyID:  data.EABKeyID,
+		EABHMAC:   data.EABHMAC,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.siteCAFile(domain), caBytes, 0600)
+}
+
+// DeleteSite implements Storage.
+func (s *FileStorage) DeleteSite(domain string) error {
+	return os.RemoveAll(s.site(domain))
+}
+
+// AllSites implements Storage.
+func (s *FileStorage) AllSites() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.sites())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	domains := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			domains = append(domains, entry.Name())
+		}
+	}
+	return domains, nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory
+// as path and then renames it into place, so that other readers of
+// path only ever see the old or the new contents, never a partial
+// write.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadUser implements Storage.
+func (s *FileStorage) LoadUser(caURL, email string) (UserData, error) {
+	var data UserData
+
+	var err error
+	data.Key, err = ioutil.ReadFile(s.userKeyFile(caURL, email))
+	if err != nil {
+		return data, err
+	}
+
+	// the registration resource isn't written until the account is
+	// actually registered with the CA, so it's fine if it's missing
+	data.Reg, err = ioutil.ReadFile(s.userRegFile(caURL, email))
+	if err != nil && !os.IsNotExist(err) {
+		return data, err
+	}
+
+	return data, nil
+}
+
+// StoreUser implements Storage.
+func (s *FileStorage) StoreUser(caURL, email string, data UserData) error {
+	err := os.MkdirAll(s.user(caURL, email), 0700)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.userKeyFile(caURL, email), data.Key, 0600)
+	if err != nil {
+		return err
+	}
+	if len(data.Reg) == 0 {
+		return nil
+	}
+	return writeFileAtomic(s.userRegFile(caURL, email), data.Reg, 0600)
+}
+
+// fileStorageLock is the Waiter returned while another process holds
+// a file-based lock file.
+type fileStorageLock struct {
+	lockFile string
+}
+
+func (w fileStorageLock) Wait() {
+	// poll the lock file until it disappears, it goes stale, or we've
+	// waited long enough
+	for i := 0; i < lockPollAttempts; i++ {
+		info, err := os.Stat(w.lockFile)
+		if os.IsNotExist(err) {
+			return
+		}
+		if err == nil && lockIsStale(info) {
+			return
+		}
+		lockPollSleep()
+	}
+}
+
+// lockPollAttempts and lockPollSleep are variables so tests (and
+// future tuning) can override the default polling behavior.
+var lockPollAttempts = 100
+var lockPollSleep = func() { time.Sleep(100 * time.Millisecond) }
+
+// staleLockTTL is how old a lock file may get before it's considered
+// abandoned (e.g. its holder crashed without cleaning up) and safe to
+// break, rather than deadlocking renewal or on-demand issuance for
+// that domain forever.
+var staleLockTTL = 2 * time.Hour
+
+// lockIsStale reports whether a lock file described by info is older
+// than staleLockTTL.
+func lockIsStale(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) > staleLockTTL
+}
+
+// TryLock implements Storage.
+func (s *FileStorage) TryLock(name string) (Waiter, error) {
+	lockFile := s.lockFile(name)
+	info, err := os.Stat(lockFile)
+	if err == nil {
+		if !lockIsStale(info) {
+			return fileStorageLock{lockFile: lockFile}, nil
+		}
+		// the previous holder appears to have crashed without
+		// releasing the lock; break it rather than wait forever
+		if err := os.Remove(lockFile); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(lockFile), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fileStorageLock{lockFile: lockFile}, nil
+		}
+		return nil, err
+	}
+	return nil, f.Close()
+}
+
+// Unlock implements Storage.
+func (s *FileStorage) Unlock(name string) error {
+	err := os.Remove(s.lockFile(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStorage) lockFile(name string) string {
+	return filepath.Join(s.Path, "locks", fmt.Sprintf("%s.lock", name))
+}
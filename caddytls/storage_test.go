@@ -0,0 +1,236 @@
+package caddytls
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCADirName(t *testing.T) {
+	for _, test := range []struct {
+		caURL string
+		want  string
+	}{
+		{"", "default"},
+		{"https://acme-v02.api.letsencrypt.org/directory", "acme-v02.api.letsencrypt.org"},
+		{"https://acme.zerossl.com/v2/DV90", "acme.zerossl.com"},
+		{"a/weird:host?name", "a_weird_host_name"},
+	} {
+		if got := caDirName(test.caURL); got != test.want {
+			t.Errorf("caDirName(%q) = %q, want %q", test.caURL, got, test.want)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file.txt")
+	if err := writeFileAtomic(path, []byte("first"), 0600); err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	if err := writeFileAtomic(path, []byte("second"), 0600); err != nil {
+		t.Fatalf("second write: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "second" {
+		t.Errorf("file contents = %q, want %q", got, "second")
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the final file to remain, found %d entries", len(entries))
+	}
+}
+
+func TestFileStorageSiteRoundTripsCAInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &FileStorage{Path: dir}
+	want := SiteData{
+		Cert:      []byte("cert"),
+		Key:       []byte("key"),
+		Meta:      []byte("{}"),
+		CAURL:     "https://acme.zerossl.com/v2/DV90",
+		CAKeyType: "EC256",
+		EABKeyID:  "kid-123",
+		EABHMAC:   "hmac-456",
+	}
+	if err := s.StoreSite("example.com", want); err != nil {
+		t.Fatalf("StoreSite: %v", err)
+	}
+
+	got, err := s.LoadSite("example.com")
+	if err != nil {
+		t.Fatalf("LoadSite: %v", err)
+	}
+	if got.CAURL != want.CAURL || got.CAKeyType != want.CAKeyType ||
+		got.EABKeyID != want.EABKeyID || got.EABHMAC != want.EABHMAC {
+		t.Errorf("LoadSite CA info = %+v, want matching fields from %+v", got, want)
+	}
+}
+
+func TestFileStorageSiteWithoutCAInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &FileStorage{Path: dir}
+	if err := s.StoreSite("example.com", SiteData{Cert: []byte("cert"), Key: []byte("key"), Meta: []byte("{}")}); err != nil {
+		t.Fatalf("StoreSite: %v", err)
+	}
+
+	if _, err := os.Stat(s.siteCAFile("example.com")); !os.IsNotExist(err) {
+		t.Error("expected no CA sidecar file to be written when no CA info is set")
+	}
+
+	got, err := s.LoadSite("example.com")
+	if err != nil {
+		t.Fatalf("LoadSite: %v", err)
+	}
+	if got.CAURL != "" || got.CAKeyType != "" || got.EABKeyID != "" || got.EABHMAC != "" {
+		t.Errorf("expected empty CA info for a site stored before this field existed, got %+v", got)
+	}
+}
+
+func TestFileStorageSiteExistsAndDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &FileStorage{Path: dir}
+
+	exists, err := s.SiteExists("example.com")
+	if err != nil {
+		t.Fatalf("SiteExists: %v", err)
+	}
+	if exists {
+		t.Fatal("expected SiteExists to report false before the site is stored")
+	}
+
+	if err := s.StoreSite("example.com", SiteData{Cert: []byte("cert"), Key: []byte("key"), Meta: []byte("{}")}); err != nil {
+		t.Fatalf("StoreSite: %v", err)
+	}
+
+	exists, err = s.SiteExists("example.com")
+	if err != nil {
+		t.Fatalf("SiteExists: %v", err)
+	}
+	if !exists {
+		t.Fatal("expected SiteExists to report true after the site is stored")
+	}
+
+	if err := s.DeleteSite("example.com"); err != nil {
+		t.Fatalf("DeleteSite: %v", err)
+	}
+
+	exists, err = s.SiteExists("example.com")
+	if err != nil {
+		t.Fatalf("SiteExists: %v", err)
+	}
+	if exists {
+		t.Fatal("expected SiteExists to report false after DeleteSite")
+	}
+}
+
+func TestFileStorageTryLockAndUnlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &FileStorage{Path: dir}
+
+	waiter, err := s.TryLock("example.com")
+	if err != nil {
+		t.Fatalf("TryLock: %v", err)
+	}
+	if waiter != nil {
+		t.Fatal("expected to acquire the lock on first try")
+	}
+
+	waiter, err = s.TryLock("example.com")
+	if err != nil {
+		t.Fatalf("TryLock while held: %v", err)
+	}
+	if waiter == nil {
+		t.Fatal("expected a Waiter while the lock is held")
+	}
+
+	if err := s.Unlock("example.com"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	waiter, err = s.TryLock("example.com")
+	if err != nil {
+		t.Fatalf("TryLock after Unlock: %v", err)
+	}
+	if waiter != nil {
+		t.Fatal("expected to reacquire the lock after it was released")
+	}
+}
+
+func TestFileStorageTryLockBreaksStaleLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origTTL := staleLockTTL
+	staleLockTTL = 50 * time.Millisecond
+	defer func() { staleLockTTL = origTTL }()
+
+	s := &FileStorage{Path: dir}
+
+	waiter, err := s.TryLock("example.com")
+	if err != nil {
+		t.Fatalf("TryLock: %v", err)
+	}
+	if waiter != nil {
+		t.Fatal("expected to acquire the lock on first try")
+	}
+
+	// a second, fresh attempt should find the lock held and not stale
+	waiter, err = s.TryLock("example.com")
+	if err != nil {
+		t.Fatalf("TryLock: %v", err)
+	}
+	if waiter == nil {
+		t.Fatal("expected the lock to still be held")
+	}
+
+	// once the lock file is older than staleLockTTL, it should be
+	// breakable rather than wait forever for a holder that crashed
+	time.Sleep(2 * staleLockTTL)
+
+	waiter, err = s.TryLock("example.com")
+	if err != nil {
+		t.Fatalf("TryLock after staleness: %v", err)
+	}
+	if waiter != nil {
+		t.Fatal("expected to break the stale lock and acquire it")
+	}
+}
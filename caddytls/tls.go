@@ -4,11 +4,10 @@
 package caddytls
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"net"
-	"os"
 	"strings"
 
 	"github.com/xenolf/lego/acme"
@@ -37,49 +36,35 @@ func HostQualifies(hostname string) bool {
 // a certificate and private key in storage already,
 // false otherwise.
 func existingCertAndKey(hostname string) bool {
-	_, err := os.Stat(storage.SiteCertFile(hostname))
-	if err != nil {
-		return false
-	}
-	_, err = os.Stat(storage.SiteKeyFile(hostname))
-	if err != nil {
-		return false
-	}
-	return true
+	exists, err := storage.SiteExists(hostname)
+	return err == nil && exists
 }
 
-// saveCertResource saves the certificate resource to disk. This
-// includes the certificate file itself, the private key, and the
-// metadata file.
-func saveCertResource(cert acme.CertificateResource) error {
-	err := os.MkdirAll(storage.Site(cert.Domain), 0700)
+// saveCertResource saves the certificate resource to storage. This
+// includes the certificate itself, the private key, the metadata,
+// and which CA (and, if applicable, external account) issued it, so
+// that renewal can return to the same CA later.
+func saveCertResource(cert acme.CertificateResource, caURL, caKeyType string, eab *ExternalAccountBinding) error {
+	jsonBytes, err := json.MarshalIndent(&cert, "", "\t")
 	if err != nil {
 		return err
 	}
 
-	// Save cert
-	err = ioutil.WriteFile(storage.SiteCertFile(cert.Domain), cert.Certificate, 0600)
-	if err != nil {
-		return err
-	}
+	startMaintenance()
 
-	// Save private key
-	err = ioutil.WriteFile(storage.SiteKeyFile(cert.Domain), cert.PrivateKey, 0600)
-	if err != nil {
-		return err
+	data := SiteData{
+		Cert:      cert.Certificate,
+		Key:       cert.PrivateKey,
+		Meta:      jsonBytes,
+		CAURL:     caURL,
+		CAKeyType: caKeyType,
 	}
-
-	// Save cert metadata
-	jsonBytes, err := json.MarshalIndent(&cert, "", "\t")
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(storage.SiteMetaFile(cert.Domain), jsonBytes, 0600)
-	if err != nil {
-		return err
+	if eab != nil {
+		data.EABKeyID = eab.KeyID
+		data.EABHMAC = eab.HMAC
 	}
 
-	return nil
+	return storage.StoreSite(cert.Domain, data)
 }
 
 // Revoke revokes the certificate for host via ACME protocol.
@@ -88,27 +73,37 @@ func Revoke(host string) error {
 		return errors.New("no certificate and key for " + host)
 	}
 
-	// TODO: Use actual config?
-	// TODO: Get email properly
-	client, err := newACMEClient(&Config{}, true)
+	site, err := storage.LoadSite(host)
 	if err != nil {
 		return err
 	}
 
-	certFile := storage.SiteCertFile(host)
-	certBytes, err := ioutil.ReadFile(certFile)
+	// talk to whichever CA (and, if applicable, external account)
+	// actually issued the certificate, not whatever happens to be
+	// configured as the package-wide default, the same way
+	// renewCertificate does
+	caURL := site.CAURL
+	if caURL == "" {
+		caURL = effectiveCAURL(nil)
+	}
+	cfg := &Config{CAKeyType: site.CAKeyType}
+	if site.EABKeyID != "" || site.EABHMAC != "" {
+		cfg.ExternalAccount = &ExternalAccountBinding{KeyID: site.EABKeyID, HMAC: site.EABHMAC}
+	}
+
+	client, err := newACMEClientForCA(cfg, caURL, true)
 	if err != nil {
 		return err
 	}
 
-	err = client.RevokeCertificate(certBytes)
+	err = client.RevokeCertificate(site.Cert)
 	if err != nil {
 		return err
 	}
 
-	err = os.Remove(certFile)
+	err = storage.DeleteSite(host)
 	if err != nil {
-		return errors.New("certificate revoked, but unable to delete certificate file: " + err.Error())
+		return errors.New("certificate revoked, but unable to delete stored certificate: " + err.Error())
 	}
 
 	return nil
@@ -137,6 +132,55 @@ func (s tlsSniSolver) CleanUp(domain, token, keyAuth string) error {
 	return nil
 }
 
+// GetCertificate is meant to be used as a tls.Config's GetCertificate
+// callback. It serves the tls-alpn-01 challenge certificate when the
+// ClientHello negotiates the acme-tls/1 protocol, and otherwise looks
+// up the cached certificate whose name exactly matches the lowercased
+// server name, obtaining one on demand if onDemandConfig allows it.
+// The tls.Config this is installed on must also advertise
+// ACMETLS1Protocol in NextProtos for that negotiation to happen at
+// all; see EnableTLSALPNChallenge.
+func GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(clientHello.ServerName)
+
+	for _, proto := range clientHello.SupportedProtos {
+		if proto == ACMETLS1Protocol {
+			cert, ok := getCertificate(name)
+			if !ok {
+				return nil, errors.New("no tls-alpn-01 challenge certificate for " + name)
+			}
+			return &cert.Certificate, nil
+		}
+	}
+
+	cert, ok := getCertificate(name)
+	if ok {
+		return &cert.Certificate, nil
+	}
+
+	if cfg := onDemandConfig; cfg != nil && cfg.OnDemand && HostQualifies(name) {
+		cert, err := obtainOnDemandCertificate(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &cert.Certificate, nil
+	}
+
+	return nil, errors.New("no certificate for " + name)
+}
+
+// onDemandConfig is the Config governing on-demand TLS issuance, set
+// by the embedding application via SetOnDemandConfig. Nil means
+// on-demand issuance is disabled.
+var onDemandConfig *Config
+
+// SetOnDemandConfig registers cfg as the Config to consult when
+// GetCertificate is asked for a hostname it has no cached
+// certificate for. Pass nil to disable on-demand issuance.
+func SetOnDemandConfig(cfg *Config) {
+	onDemandConfig = cfg
+}
+
 // ConfigHolder is any type that has a Config; it presumably is
 // connected to a hostname and port on which it is serving.
 type ConfigHolder interface {
@@ -194,4 +238,4 @@ var (
 
 	// CAUrl represents the default URL to the CA's ACME directory endpoint.
 	CAUrl string
-)
\ No newline at end of file
+)
@@ -0,0 +1,135 @@
+package caddytls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+)
+
+// ACMETLS1Protocol is the ALPN protocol name that a ClientHello
+// advertises when it is asking Caddy to solve a tls-alpn-01 challenge,
+// per https://tools.ietf.org/html/rfc8737.
+const ACMETLS1Protocol = "acme-tls/1"
+
+// idPeAcmeIdentifierV1 is the OID of the critical extension that
+// carries the key authorization digest in a tls-alpn-01 challenge
+// certificate.
+var idPeAcmeIdentifierV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// tlsALPNSolver solves the ACME tls-alpn-01 challenge by presenting a
+// self-signed certificate over a TLS connection negotiated with the
+// acme-tls/1 ALPN protocol; see tls.go's GetCertificate hook.
+type tlsALPNSolver struct{}
+
+// Present generates the tls-alpn-01 challenge certificate for domain
+// and caches it so the TLS listener can serve it.
+func (s tlsALPNSolver) Present(domain, token, keyAuth string) error {
+	cert, err := tlsALPNChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	cacheCertificate(Certificate{
+		Certificate: cert,
+		Names:       []string{domain},
+	})
+	return nil
+}
+
+// CleanUp removes the challenge certificate from the cache.
+func (s tlsALPNSolver) CleanUp(domain, token, keyAuth string) error {
+	uncacheCertificate(domain)
+	return nil
+}
+
+// EnableTLSALPNChallenge makes sure cfg is set up to solve the
+// tls-alpn-01 challenge. Go's server only ever negotiates an ALPN
+// protocol that's listed in its own tls.Config.NextProtos, so
+// GetCertificate serving the right certificate isn't enough on its
+// own: the listener's tls.Config must also advertise
+// ACMETLS1Protocol, or a validating CA's connection will never
+// actually negotiate acme-tls/1 as RFC 8737 requires. Callers that
+// build their own tls.Config around GetCertificate should call this
+// on it before using it to serve.
+func EnableTLSALPNChallenge(cfg *tls.Config) {
+	if cfg.GetCertificate == nil {
+		cfg.GetCertificate = GetCertificate
+	}
+	for _, proto := range cfg.NextProtos {
+		if proto == ACMETLS1Protocol {
+			return
+		}
+	}
+	cfg.NextProtos = append(cfg.NextProtos, ACMETLS1Protocol)
+}
+
+// NewTLSConfig builds a tls.Config ready to serve cfg's managed
+// certificates: GetCertificate is wired up, and if tls-alpn-01 is
+// among cfg's preferred challenge types, ACMETLS1Protocol is already
+// in NextProtos so the challenge can actually be negotiated. This is
+// the easiest way to get a correctly configured tls.Config; callers
+// assembling their own should call EnableTLSALPNChallenge directly
+// instead.
+func NewTLSConfig(cfg *Config) *tls.Config {
+	tlsConfig := &tls.Config{GetCertificate: GetCertificate}
+	for _, typ := range preferredChallengeTypes(cfg) {
+		if typ == "tls-alpn-01" {
+			EnableTLSALPNChallenge(tlsConfig)
+			break
+		}
+	}
+	return tlsConfig
+}
+
+// tlsALPNChallengeCert builds a self-signed certificate for domain
+// whose SAN is domain and which carries a critical extension holding
+// the DER-encoded OCTET STRING of SHA-256(keyAuth), as required by
+// the tls-alpn-01 challenge.
+func tlsALPNChallengeCert(domain, keyAuth string) (tls.Certificate, error) {
+	zBytes := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(zBytes[:])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Caddy ACME TLS-ALPN Challenge"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{domain},
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:       idPeAcmeIdentifierV1,
+				Critical: true,
+				Value:    value,
+			},
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
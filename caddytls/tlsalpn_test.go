@@ -0,0 +1,78 @@
+package caddytls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestTLSALPNChallengeCert(t *testing.T) {
+	const domain = "example.com"
+	const keyAuth = "token.thumbprint"
+
+	tlsCert, err := tlsALPNChallengeCert(domain, keyAuth)
+	if err != nil {
+		t.Fatalf("tlsALPNChallengeCert: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing generated certificate: %v", err)
+	}
+
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != domain {
+		t.Fatalf("DNSNames = %v, want [%s]", leaf.DNSNames, domain)
+	}
+
+	var found bool
+	wantHash := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(idPeAcmeIdentifierV1) {
+			continue
+		}
+		found = true
+		if !ext.Critical {
+			t.Error("acmeIdentifier extension must be marked critical")
+		}
+		var gotHash []byte
+		if _, err := asn1.Unmarshal(ext.Value, &gotHash); err != nil {
+			t.Fatalf("unmarshaling extension value: %v", err)
+		}
+		if string(gotHash) != string(wantHash[:]) {
+			t.Errorf("extension carries SHA-256(keyAuth) = %x, want %x", gotHash, wantHash)
+		}
+	}
+	if !found {
+		t.Fatal("certificate missing id-pe-acmeIdentifier extension")
+	}
+}
+
+func TestEnableTLSALPNChallenge(t *testing.T) {
+	cfg := &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+
+	EnableTLSALPNChallenge(cfg)
+	if cfg.GetCertificate == nil {
+		t.Error("GetCertificate not set by EnableTLSALPNChallenge")
+	}
+	if count(cfg.NextProtos, ACMETLS1Protocol) != 1 {
+		t.Fatalf("NextProtos = %v, want exactly one %q", cfg.NextProtos, ACMETLS1Protocol)
+	}
+
+	// calling it again shouldn't duplicate the entry
+	EnableTLSALPNChallenge(cfg)
+	if count(cfg.NextProtos, ACMETLS1Protocol) != 1 {
+		t.Fatalf("NextProtos = %v, want exactly one %q after a second call", cfg.NextProtos, ACMETLS1Protocol)
+	}
+}
+
+func count(protos []string, want string) int {
+	n := 0
+	for _, p := range protos {
+		if p == want {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package caddytls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// ACMEUser represents a Caddy user (account holder) for purposes
+// of ACME client interactions. It implements acme.User.
+type ACMEUser struct {
+	Email        string
+	Registration *acme.RegistrationResource
+	key          *ecdsa.PrivateKey
+}
+
+// GetEmail implements acme.User.
+func (u ACMEUser) GetEmail() string { return u.Email }
+
+// GetRegistration implements acme.User.
+func (u ACMEUser) GetRegistration() *acme.RegistrationResource { return u.Registration }
+
+// GetPrivateKey implements acme.User.
+func (u ACMEUser) GetPrivateKey() crypto.PrivateKey { return u.key }
+
+// getOrCreateUser loads the account for (caURL, email) from storage,
+// generating a new key if it doesn't already exist. Accounts are
+// namespaced per-CA so that, e.g., switching a vhost from Let's
+// Encrypt to a private CA doesn't clobber (or get confused with) the
+// Let's Encrypt account for the same email. needsRegistration reports
+// whether the caller still needs to register (or re-register) the
+// account with the CA before using it for anything else, per ACME's
+// requirement that newAccount precede other requests: that's true not
+// only for a brand new account, but also for one whose key was
+// stored but whose registration never completed (e.g. a crash between
+// the two).
+func getOrCreateUser(caURL, email string, allowPrompts bool) (user ACMEUser, needsRegistration bool, err error) {
+	userData, err := storage.LoadUser(caURL, email)
+	if err == nil {
+		key, err := loadEllipticPrivateKey(userData.Key)
+		if err != nil {
+			return user, false, err
+		}
+		user.Email = email
+		user.key = key
+		if len(userData.Reg) > 0 {
+			if err := json.Unmarshal(userData.Reg, &user.Registration); err != nil {
+				return user, false, err
+			}
+		}
+		return user, len(userData.Reg) == 0, nil
+	}
+
+	// no account in storage yet; generate a new one
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return user, false, err
+	}
+	user.Email = email
+	user.key = key
+
+	keyBytes, err := marshalEllipticPrivateKey(key)
+	if err != nil {
+		return user, false, err
+	}
+	if err := storage.StoreUser(caURL, email, UserData{Key: keyBytes}); err != nil {
+		return user, false, err
+	}
+
+	return user, true, nil
+}
+
+// storeUserRegistration persists user's registration resource (the
+// result of registering with the CA, possibly via external account
+// binding) alongside its already-stored private key.
+func storeUserRegistration(caURL string, user ACMEUser) error {
+	keyBytes, err := marshalEllipticPrivateKey(user.key)
+	if err != nil {
+		return err
+	}
+	regBytes, err := json.Marshal(user.Registration)
+	if err != nil {
+		return err
+	}
+	return storage.StoreUser(caURL, user.Email, UserData{Key: keyBytes, Reg: regBytes})
+}
+
+// loadEllipticPrivateKey parses a DER-encoded EC private key.
+func loadEllipticPrivateKey(der []byte) (*ecdsa.PrivateKey, error) {
+	return x509.ParseECPrivateKey(der)
+}
+
+// marshalEllipticPrivateKey DER-encodes an EC private key.
+func marshalEllipticPrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	return x509.MarshalECPrivateKey(key)
+}